@@ -0,0 +1,22 @@
+package cbs
+
+import (
+	"fmt"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+// validateVolumeCapability checks that cap's access type is one this
+// driver supports (Block or Mount) and reports which one, so
+// ValidateVolumeCapabilities and the Node RPCs share one
+// definition of what CBS can serve.
+func validateVolumeCapability(cap *csi.VolumeCapability) (isBlock bool, err error) {
+	if cap == nil {
+		return false, fmt.Errorf("volume has no capabilities")
+	}
+	isBlock = cap.GetBlock() != nil
+	if !isBlock && cap.GetMount() == nil {
+		return false, fmt.Errorf("volume access type is not mount or block")
+	}
+	return isBlock, nil
+}
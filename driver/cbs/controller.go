@@ -0,0 +1,62 @@
+package cbs
+
+import (
+	"context"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// cbsController implements the ControllerServer RPCs this package is
+// responsible for; RPCs it doesn't override fall through to
+// csi.UnimplementedControllerServer.
+type cbsController struct {
+	csi.UnimplementedControllerServer
+}
+
+func newCbsController() *cbsController {
+	return &cbsController{}
+}
+
+var controllerCapabilities = []*csi.ControllerServiceCapability{
+	newControllerServiceCapability(csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME),
+	newControllerServiceCapability(csi.ControllerServiceCapability_RPC_PUBLISH_UNPUBLISH_VOLUME),
+	newControllerServiceCapability(csi.ControllerServiceCapability_RPC_EXPAND_VOLUME),
+}
+
+func newControllerServiceCapability(rpcType csi.ControllerServiceCapability_RPC_Type) *csi.ControllerServiceCapability {
+	return &csi.ControllerServiceCapability{
+		Type: &csi.ControllerServiceCapability_Rpc{
+			Rpc: &csi.ControllerServiceCapability_RPC{Type: rpcType},
+		},
+	}
+}
+
+func (c *cbsController) ControllerGetCapabilities(ctx context.Context, req *csi.ControllerGetCapabilitiesRequest) (*csi.ControllerGetCapabilitiesResponse, error) {
+	return &csi.ControllerGetCapabilitiesResponse{Capabilities: controllerCapabilities}, nil
+}
+
+// ValidateVolumeCapabilities confirms volumeCapabilities are ones this
+// driver can serve, sharing the Block/Mount check the Node RPCs use so a
+// raw block PVC isn't rejected here and then accepted by NodeStageVolume.
+func (c *cbsController) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (*csi.ValidateVolumeCapabilitiesResponse, error) {
+	if req.GetVolumeId() == "" {
+		return nil, status.Error(codes.InvalidArgument, "volume ID missing")
+	}
+	if len(req.GetVolumeCapabilities()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "volume capabilities missing")
+	}
+
+	for _, cap := range req.GetVolumeCapabilities() {
+		if _, err := validateVolumeCapability(cap); err != nil {
+			return &csi.ValidateVolumeCapabilitiesResponse{Message: err.Error()}, nil
+		}
+	}
+
+	return &csi.ValidateVolumeCapabilitiesResponse{
+		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+			VolumeCapabilities: req.GetVolumeCapabilities(),
+		},
+	}, nil
+}
@@ -0,0 +1,42 @@
+package cbs
+
+import (
+	"context"
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+func TestValidateVolumeCapabilitiesAcceptsBlock(t *testing.T) {
+	c := newCbsController()
+	req := &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId: "disk-abc",
+		VolumeCapabilities: []*csi.VolumeCapability{
+			{AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}}},
+		},
+	}
+
+	resp, err := c.ValidateVolumeCapabilities(context.Background(), req)
+	if err != nil {
+		t.Fatalf("ValidateVolumeCapabilities() error = %v", err)
+	}
+	if resp.Confirmed == nil {
+		t.Fatalf("expected Block capability to be confirmed, got message %q", resp.Message)
+	}
+}
+
+func TestValidateVolumeCapabilitiesRejectsUnsupportedAccessType(t *testing.T) {
+	c := newCbsController()
+	req := &csi.ValidateVolumeCapabilitiesRequest{
+		VolumeId:           "disk-abc",
+		VolumeCapabilities: []*csi.VolumeCapability{{}},
+	}
+
+	resp, err := c.ValidateVolumeCapabilities(context.Background(), req)
+	if err != nil {
+		t.Fatalf("ValidateVolumeCapabilities() error = %v", err)
+	}
+	if resp.Confirmed != nil {
+		t.Fatal("expected an empty access type to be rejected")
+	}
+}
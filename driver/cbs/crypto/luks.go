@@ -0,0 +1,88 @@
+// Package crypto wraps the cryptsetup CLI for LUKS-encrypted CBS volumes.
+package crypto
+
+import (
+	"fmt"
+	"strings"
+
+	"k8s.io/utils/exec"
+)
+
+const mapperPathPrefix = "/dev/mapper/"
+
+// MapperPath returns the /dev/mapper path volumeID's LUKS device opens at.
+func MapperPath(volumeID string) string {
+	return mapperPathPrefix + mapperName(volumeID)
+}
+
+func mapperName(volumeID string) string {
+	return "cbs-" + volumeID
+}
+
+// IsLuks reports whether device is already formatted as a LUKS volume.
+func IsLuks(execer exec.Interface, device string) (bool, error) {
+	err := execer.Command("cryptsetup", "isLuks", device).Run()
+	if err == nil {
+		return true, nil
+	}
+	if exitErr, ok := err.(exec.ExitError); ok {
+		// cryptsetup isLuks exits 1 when the device is not a LUKS device.
+		if exitErr.ExitStatus() == 1 {
+			return false, nil
+		}
+	}
+	return false, fmt.Errorf("cryptsetup isLuks %s: %v", device, err)
+}
+
+// Format runs luksFormat on device with passphrase.
+func Format(execer exec.Interface, device, passphrase string) error {
+	cmd := execer.Command("cryptsetup", "-q", "luksFormat", device, "-")
+	if err := runWithStdin(cmd, passphrase); err != nil {
+		return fmt.Errorf("cryptsetup luksFormat %s: %v", device, err)
+	}
+	return nil
+}
+
+// Open maps device's LUKS payload to MapperPath(volumeID) using passphrase.
+func Open(execer exec.Interface, device, volumeID, passphrase string) error {
+	cmd := execer.Command("cryptsetup", "luksOpen", device, mapperName(volumeID), "-")
+	if err := runWithStdin(cmd, passphrase); err != nil {
+		return fmt.Errorf("cryptsetup luksOpen %s: %v", device, err)
+	}
+	return nil
+}
+
+// Close tears down the mapper device for volumeID.
+func Close(execer exec.Interface, volumeID string) error {
+	if err := execer.Command("cryptsetup", "luksClose", mapperName(volumeID)).Run(); err != nil {
+		if IsInactive(execer, volumeID) {
+			return nil
+		}
+		return fmt.Errorf("cryptsetup luksClose %s: %v", mapperName(volumeID), err)
+	}
+	return nil
+}
+
+// Resize grows the mapper device for volumeID to fill the underlying device.
+func Resize(execer exec.Interface, volumeID string) error {
+	if err := execer.Command("cryptsetup", "resize", mapperName(volumeID)).Run(); err != nil {
+		return fmt.Errorf("cryptsetup resize %s: %v", mapperName(volumeID), err)
+	}
+	return nil
+}
+
+// IsInactive reports whether the mapper for volumeID is absent or stale.
+func IsInactive(execer exec.Interface, volumeID string) bool {
+	output, err := execer.Command("cryptsetup", "status", mapperName(volumeID)).CombinedOutput()
+	if err != nil {
+		// cryptsetup status exits non-zero for an inactive/nonexistent mapping.
+		return true
+	}
+	return strings.Contains(string(output), "device:  (null)")
+}
+
+func runWithStdin(cmd exec.Cmd, stdin string) error {
+	cmd.SetStdin(strings.NewReader(stdin))
+	_, err := cmd.CombinedOutput()
+	return err
+}
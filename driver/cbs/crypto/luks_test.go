@@ -0,0 +1,19 @@
+package crypto
+
+import "testing"
+
+func TestMapperName(t *testing.T) {
+	got := mapperName("disk-12345")
+	want := "cbs-disk-12345"
+	if got != want {
+		t.Fatalf("mapperName() = %q, want %q", got, want)
+	}
+}
+
+func TestMapperPath(t *testing.T) {
+	got := MapperPath("disk-12345")
+	want := "/dev/mapper/cbs-disk-12345"
+	if got != want {
+		t.Fatalf("MapperPath() = %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,200 @@
+package cbs
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"path/filepath"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+)
+
+const (
+	healTimeout = 2 * time.Minute
+
+	// kubeletRootDir is kubelet's default --root-dir; CSI staging paths
+	// are always computed relative to it.
+	kubeletRootDir = "/var/lib/kubelet"
+
+	healListAttempts  = 3
+	healListRetryWait = 5 * time.Second
+)
+
+// kubeletStagingTargetPath reproduces the deterministic staging path
+// kubelet derives for a CSI volume, so it can be recomputed here without
+// any persisted or attacher-reported state.
+func kubeletStagingTargetPath(volumeHandle string) string {
+	sum := sha256.Sum256([]byte(volumeHandle))
+	return filepath.Join(kubeletRootDir, "plugins", "kubernetes.io", "csi", DriverName, fmt.Sprintf("%x", sum), "globalmount")
+}
+
+// volumeHealerBackend re-establishes a staged volume's node-local state;
+// a hook point for future encrypted/userspace-mounted backends.
+type volumeHealerBackend interface {
+	heal(node *cbsNode, req *csi.NodeStageVolumeRequest) error
+}
+
+type blockDeviceHealerBackend struct{}
+
+func (blockDeviceHealerBackend) heal(node *cbsNode, req *csi.NodeStageVolumeRequest) error {
+	_, err := node.NodeStageVolume(healingContext(), req)
+	return err
+}
+
+func healerBackendFor(attrs map[string]string) volumeHealerBackend {
+	return blockDeviceHealerBackend{}
+}
+
+// healVolumes runs once at nodeplugin startup and replays NodeStageVolume
+// for every VolumeAttachment on this node that should already be staged.
+func (node *cbsNode) healVolumes() {
+	defer close(node.healDone)
+
+	start := time.Now()
+	attachments, err := listVolumeAttachmentsWithRetry(node.kubeClient)
+	if err != nil {
+		glog.Errorf("healVolumes: giving up listing VolumeAttachments after %d attempts (%v) — "+
+			"serving RPCs without healing any volume state, check the node ServiceAccount's RBAC", healListAttempts, err)
+		return
+	}
+
+	healed := 0
+	for _, att := range attachments.Items {
+		if att.Spec.Attacher != DriverName {
+			continue
+		}
+		if att.Spec.NodeName != node.nodeName {
+			continue
+		}
+		if att.Spec.Source.PersistentVolumeName == nil {
+			continue
+		}
+
+		req, err := node.healRequestForAttachment(att)
+		if err != nil {
+			glog.Warningf("healVolumes: skip VolumeAttachment %v: %v", att.Name, err)
+			continue
+		}
+		if req == nil {
+			continue
+		}
+
+		backend := healerBackendFor(req.VolumeContext)
+		if err := backend.heal(node, req); err != nil {
+			glog.Errorf("healVolumes: re-stage volume %v error %v", req.VolumeId, err)
+			continue
+		}
+		healed++
+	}
+
+	glog.Infof("healVolumes: healed %d volume(s) on node %v in %v", healed, node.nodeName, time.Since(start))
+}
+
+func listVolumeAttachmentsWithRetry(kubeClient kubernetes.Interface) (*storagev1.VolumeAttachmentList, error) {
+	var attachments *storagev1.VolumeAttachmentList
+	var err error
+	for attempt := 1; attempt <= healListAttempts; attempt++ {
+		attachments, err = kubeClient.StorageV1().VolumeAttachments().List(context.Background(), metav1.ListOptions{})
+		if err == nil {
+			return attachments, nil
+		}
+		glog.Errorf("healVolumes: list VolumeAttachments attempt %d/%d error %v", attempt, healListAttempts, err)
+		if attempt < healListAttempts {
+			time.Sleep(healListRetryWait)
+		}
+	}
+	return nil, err
+}
+
+// healRequestForAttachment synthesizes the NodeStageVolumeRequest that staged
+// att, or a nil request if att isn't staged and there's nothing to heal.
+//
+// It can't read the staging path back off att.Status.AttachmentMetadata:
+// that map is populated verbatim from this driver's own
+// ControllerPublishVolumeResponse.PublishContext, computed on the
+// controller before kubelet has decided where to stage anything. Instead
+// it recomputes kubelet's own deterministic staging path.
+func (node *cbsNode) healRequestForAttachment(att storagev1.VolumeAttachment) (*csi.NodeStageVolumeRequest, error) {
+	if !att.Status.Attached {
+		return nil, nil
+	}
+
+	pvName := *att.Spec.Source.PersistentVolumeName
+	pv, err := node.kubeClient.CoreV1().PersistentVolumes().Get(context.Background(), pvName, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if pv.Spec.CSI == nil || pv.Spec.CSI.Driver != DriverName {
+		return nil, nil
+	}
+
+	req := &csi.NodeStageVolumeRequest{
+		VolumeId:          pv.Spec.CSI.VolumeHandle,
+		StagingTargetPath: kubeletStagingTargetPath(pv.Spec.CSI.VolumeHandle),
+		VolumeContext:     pv.Spec.CSI.VolumeAttributes,
+		VolumeCapability:  volumeCapabilityForMode(pv.Spec.VolumeMode, pv.Spec.CSI.FSType, pv.Spec.MountOptions),
+	}
+
+	if ref := pv.Spec.CSI.NodeStageSecretRef; ref != nil {
+		secret, err := node.kubeClient.CoreV1().Secrets(ref.Namespace).Get(context.Background(), ref.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		req.Secrets = secretDataToMap(secret)
+	}
+
+	return req, nil
+}
+
+func volumeCapabilityForMode(mode *corev1.PersistentVolumeMode, fsType string, mountOptions []string) *csi.VolumeCapability {
+	if mode != nil && *mode == corev1.PersistentVolumeBlock {
+		return &csi.VolumeCapability{
+			AccessType: &csi.VolumeCapability_Block{
+				Block: &csi.VolumeCapability_BlockVolume{},
+			},
+		}
+	}
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{
+			Mount: &csi.VolumeCapability_MountVolume{
+				FsType:     fsType,
+				MountFlags: mountOptions,
+			},
+		},
+	}
+}
+
+func secretDataToMap(secret *corev1.Secret) map[string]string {
+	data := make(map[string]string, len(secret.Data))
+	for k, v := range secret.Data {
+		data[k] = string(v)
+	}
+	return data
+}
+
+// healingCtxKey marks the healer's own NodeStageVolume replay so waitForHeal
+// doesn't block on node.healDone from inside the goroutine that closes it.
+type healingCtxKey struct{}
+
+func healingContext() context.Context {
+	return context.WithValue(context.Background(), healingCtxKey{}, true)
+}
+
+// waitForHeal blocks until the startup healer finishes or healTimeout elapses.
+func (node *cbsNode) waitForHeal(ctx context.Context) {
+	if ctx.Value(healingCtxKey{}) != nil {
+		return
+	}
+
+	select {
+	case <-node.healDone:
+	case <-time.After(healTimeout):
+		glog.Warningf("waitForHeal: timed out after %v waiting for volume healer", healTimeout)
+	}
+}
@@ -0,0 +1,88 @@
+package cbs
+
+import (
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	storagev1 "k8s.io/api/storage/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func TestHealRequestForAttachment(t *testing.T) {
+	pvName := "pvc-1234"
+	pv := &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{Name: pvName},
+		Spec: corev1.PersistentVolumeSpec{
+			MountOptions: []string{"noatime"},
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				CSI: &corev1.CSIPersistentVolumeSource{
+					Driver:       DriverName,
+					VolumeHandle: "disk-abc",
+					FSType:       "ext4",
+				},
+			},
+		},
+	}
+
+	// Shaped like what the real external-attacher produces: Attached with
+	// no AttachmentMetadata, since ControllerPublishVolume runs before
+	// kubelet picks a staging path.
+	att := storagev1.VolumeAttachment{
+		Spec: storagev1.VolumeAttachmentSpec{
+			Attacher: DriverName,
+			NodeName: "node-1",
+			Source:   storagev1.VolumeAttachmentSource{PersistentVolumeName: &pvName},
+		},
+		Status: storagev1.VolumeAttachmentStatus{Attached: true},
+	}
+
+	node := &cbsNode{
+		kubeClient: fake.NewSimpleClientset(pv),
+		nodeName:   "node-1",
+	}
+
+	req, err := node.healRequestForAttachment(att)
+	if err != nil {
+		t.Fatalf("healRequestForAttachment() error = %v", err)
+	}
+	if req == nil {
+		t.Fatal("healRequestForAttachment() = nil, want a request to replay")
+	}
+
+	wantPath := kubeletStagingTargetPath("disk-abc")
+	if req.StagingTargetPath != wantPath {
+		t.Fatalf("StagingTargetPath = %q, want %q", req.StagingTargetPath, wantPath)
+	}
+	if req.VolumeId != "disk-abc" {
+		t.Fatalf("VolumeId = %q, want %q", req.VolumeId, "disk-abc")
+	}
+	mount := req.VolumeCapability.GetMount()
+	if mount == nil {
+		t.Fatal("expected a Mount access type")
+	}
+	if len(mount.MountFlags) != 1 || mount.MountFlags[0] != "noatime" {
+		t.Fatalf("MountFlags = %v, want [noatime]", mount.MountFlags)
+	}
+}
+
+func TestHealRequestForAttachmentNotAttached(t *testing.T) {
+	pvName := "pvc-1234"
+	att := storagev1.VolumeAttachment{
+		Spec: storagev1.VolumeAttachmentSpec{
+			Attacher: DriverName,
+			NodeName: "node-1",
+			Source:   storagev1.VolumeAttachmentSource{PersistentVolumeName: &pvName},
+		},
+	}
+
+	node := &cbsNode{kubeClient: fake.NewSimpleClientset(), nodeName: "node-1"}
+
+	req, err := node.healRequestForAttachment(att)
+	if err != nil {
+		t.Fatalf("healRequestForAttachment() error = %v", err)
+	}
+	if req != nil {
+		t.Fatalf("healRequestForAttachment() = %v, want nil for an unattached VolumeAttachment", req)
+	}
+}
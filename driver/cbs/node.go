@@ -13,6 +13,8 @@ import (
 	"golang.org/x/net/context"
 	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/status"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 	"k8s.io/kubernetes/pkg/util/resizefs"
 	"k8s.io/kubernetes/pkg/volume"
 	"k8s.io/utils/exec"
@@ -22,9 +24,19 @@ import (
 	"github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common"
 	"github.com/tencentcloud/tencentcloud-sdk-go/tencentcloud/common/profile"
 
+	"github.com/tencentcloud/kubernetes-csi-tencentcloud/driver/cbs/crypto"
 	"github.com/tencentcloud/kubernetes-csi-tencentcloud/driver/util"
 )
 
+const (
+	// encryptedVolumeAttributeKey is the StorageClass parameter / PV
+	// VolumeAttribute that opts a volume into LUKS encryption-at-rest.
+	encryptedVolumeAttributeKey = "encrypted"
+	// passphraseSecretKey is the key holding the LUKS passphrase in the
+	// secret referenced by csi.storage.k8s.io/node-stage-secret-name.
+	passphraseSecretKey = "passphrase"
+)
+
 var (
 	DiskByIDDevicePath       = "/dev/disk/by-id"
 	DiskByIDDeviceNamePrefix = "virtio-"
@@ -42,16 +54,31 @@ type cbsNode struct {
 	metadataClient *metadata.MetaData
 	cbsClient      *cbs.Client
 	mounter        mount.SafeFormatAndMount
-	idempotent     *util.Idempotent
+	volumeLocks    *util.VolumeLocks
+
+	kubeClient kubernetes.Interface
+	nodeName   string
+	// healDone is closed once the startup volume healer has finished;
+	// Node RPCs wait on it via waitForHeal, for at most healTimeout,
+	// before touching any volume state.
+	healDone chan struct{}
 }
 
-// TODO  node plugin need idempotent and should use inflight
-func newCbsNode(secretId, secretKey, region string) (*cbsNode, error) {
+func newCbsNode(secretId, secretKey, region, nodeName string) (*cbsNode, error) {
 	client, err := cbs.NewClient(common.NewCredential(secretId, secretKey), region, profile.NewClientProfile())
 	if err != nil {
 		return nil, err
 	}
 
+	kubeConfig, err := rest.InClusterConfig()
+	if err != nil {
+		return nil, err
+	}
+	kubeClient, err := kubernetes.NewForConfig(kubeConfig)
+	if err != nil {
+		return nil, err
+	}
+
 	node := cbsNode{
 		metadataClient: metadata.NewMetaData(http.DefaultClient),
 		cbsClient:      client,
@@ -59,54 +86,62 @@ func newCbsNode(secretId, secretKey, region string) (*cbsNode, error) {
 			Interface: mount.New(""),
 			Exec:      exec.New(),
 		},
-		idempotent: util.NewIdempotent(),
+		volumeLocks: util.NewVolumeLocks(),
+		kubeClient:  kubeClient,
+		nodeName:    nodeName,
+		healDone:    make(chan struct{}),
 	}
+
+	go node.healVolumes()
+
 	return &node, nil
 }
 
 func (node *cbsNode) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
 	glog.Infof("NodeStageVolume: start with args %v", *req)
 
+	node.waitForHeal(ctx)
+
 	if req.VolumeId == "" {
 		return nil, status.Error(codes.InvalidArgument, "volume id is empty")
 	}
 	if req.StagingTargetPath == "" {
 		return nil, status.Error(codes.InvalidArgument, "volume staging target path is empty")
 	}
-	if req.VolumeCapability == nil {
-		return nil, status.Error(codes.InvalidArgument, "volume has no capabilities")
-	}
-	// cbs is not support rawblock currently
-	if req.VolumeCapability.GetMount() == nil {
-		return nil, status.Error(codes.InvalidArgument, "volume access type is not mount")
+	isBlock, err := validateVolumeCapability(req.VolumeCapability)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
 	// 1. check if current req is in progress.
-	if ok := node.idempotent.Insert(req); !ok {
-		msg := fmt.Sprintf("volume %v is in progress", req.VolumeId)
-		return nil, status.Error(codes.Internal, msg)
+	if !node.volumeLocks.TryAcquire(req.VolumeId) {
+		return nil, status.Errorf(codes.Aborted, "operation already in progress for volume %s", req.VolumeId)
 	}
-
-	defer func() {
-		glog.Infof("NodeStageVolume: volume %v finished", req.VolumeId)
-		node.idempotent.Delete(req)
-	}()
+	defer node.volumeLocks.Release(req.VolumeId)
 
 	diskID := req.VolumeId
 
 	stagingTargetPath := req.StagingTargetPath
 
-	mountFlags := req.VolumeCapability.GetMount().MountFlags
-	mountFsType := req.VolumeCapability.GetMount().FsType
-
-	if _, err := os.Stat(stagingTargetPath); err != nil {
-		if os.IsNotExist(err) {
-			err := os.MkdirAll(stagingTargetPath, 0750)
-			if err != nil {
+	var mountFlags []string
+	var mountFsType string
+	if isBlock {
+		if err := ensureBlockTargetFile(stagingTargetPath); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	} else {
+		mountFlags = req.VolumeCapability.GetMount().MountFlags
+		mountFsType = req.VolumeCapability.GetMount().FsType
+
+		if _, err := os.Stat(stagingTargetPath); err != nil {
+			if os.IsNotExist(err) {
+				err := os.MkdirAll(stagingTargetPath, 0750)
+				if err != nil {
+					return nil, status.Error(codes.Internal, err.Error())
+				}
+			} else {
 				return nil, status.Error(codes.Internal, err.Error())
 			}
-		} else {
-			return nil, status.Error(codes.Internal, err.Error())
 		}
 	}
 
@@ -118,29 +153,108 @@ func (node *cbsNode) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolu
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
-	device, _, err := mount.GetDeviceNameFromMount(node.mounter, stagingTargetPath)
+	mountSource := diskSource
+	if !isBlock && req.VolumeContext[encryptedVolumeAttributeKey] == "true" {
+		mountSource, err = node.openLuksVolume(diskID, diskSource, req.Secrets[passphraseSecretKey])
+		if err != nil {
+			glog.Errorf("NodeStageVolume: openLuksVolume diskSource %v error %v", diskSource, err)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	notMnt, err := mount.IsNotMountPoint(node.mounter, stagingTargetPath)
 	if err != nil {
-		glog.Errorf("NodeStageVolume: GetDeviceNameFromMount error %v", err)
+		glog.Errorf("NodeStageVolume: IsNotMountPoint error %v", err)
 		return nil, status.Error(codes.Internal, err.Error())
 	}
-	if diskSource == device {
+	if !notMnt {
+		device, _, err := mount.GetDeviceNameFromMount(node.mounter, stagingTargetPath)
+		if err != nil {
+			glog.Errorf("NodeStageVolume: GetDeviceNameFromMount error %v", err)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		if device != mountSource {
+			msg := fmt.Sprintf("stagingTargetPath %v already mounted from %v, expected %v", stagingTargetPath, device, mountSource)
+			return nil, status.Error(codes.FailedPrecondition, msg)
+		}
 		glog.Infof("NodeStageVolume: volume %v already staged", diskID)
 		return &csi.NodeStageVolumeResponse{}, nil
 	}
 
-	if err := node.mounter.FormatAndMount(diskSource, stagingTargetPath, mountFsType, mountFlags); err != nil {
+	if isBlock {
+		if err := node.mounter.Mount(diskSource, stagingTargetPath, "", []string{"bind"}); err != nil {
+			glog.Errorf(
+				"NodeStageVolume: bind mount block device error diskSource %v stagingTargetPath %v, error %v",
+				diskSource, stagingTargetPath, err)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	if err := node.mounter.FormatAndMount(mountSource, stagingTargetPath, mountFsType, mountFlags); err != nil {
 		glog.Errorf(
-			"NodeStageVolume: FormatAndMount error diskSource %v stagingTargetPath %v, error %v",
-			diskSource, stagingTargetPath, err)
+			"NodeStageVolume: FormatAndMount error mountSource %v stagingTargetPath %v, error %v",
+			mountSource, stagingTargetPath, err)
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
 	return &csi.NodeStageVolumeResponse{}, nil
 }
 
+// openLuksVolume formats device as LUKS on first use and maps it to
+// /dev/mapper/cbs-<volumeID>, returning the mapper path to mount instead
+// of the raw device.
+func (node *cbsNode) openLuksVolume(volumeID, device, passphrase string) (string, error) {
+	if !crypto.IsInactive(node.mounter.Exec, volumeID) {
+		return crypto.MapperPath(volumeID), nil
+	}
+
+	if err := crypto.Close(node.mounter.Exec, volumeID); err != nil {
+		return "", err
+	}
+
+	isLuks, err := crypto.IsLuks(node.mounter.Exec, device)
+	if err != nil {
+		return "", err
+	}
+	if !isLuks {
+		if err := crypto.Format(node.mounter.Exec, device, passphrase); err != nil {
+			return "", err
+		}
+	}
+
+	if err := crypto.Open(node.mounter.Exec, device, volumeID, passphrase); err != nil {
+		return "", err
+	}
+
+	return crypto.MapperPath(volumeID), nil
+}
+
+// ensureBlockTargetFile makes sure path exists as a regular file, for
+// bind-mounting a raw block device node onto.
+func ensureBlockTargetFile(path string) error {
+	if _, err := os.Stat(path); err == nil {
+		return nil
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0750); err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE, 0660)
+	if err != nil {
+		return err
+	}
+	return f.Close()
+}
+
 func (node *cbsNode) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
 	glog.Infof("NodeUnstageVolume: start with args %v", *req)
 
+	node.waitForHeal(ctx)
+
 	if req.StagingTargetPath == "" {
 		return nil, status.Error(codes.InvalidArgument, "volume staging target path is empty")
 	}
@@ -148,8 +262,24 @@ func (node *cbsNode) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstage
 		return nil, status.Error(codes.InvalidArgument, "volume id is empty")
 	}
 
+	if !node.volumeLocks.TryAcquire(req.VolumeId) {
+		return nil, status.Errorf(codes.Aborted, "operation already in progress for volume %s", req.VolumeId)
+	}
+	defer node.volumeLocks.Release(req.VolumeId)
+
 	stagingTargetPath := req.StagingTargetPath
 
+	// A retry after a successful unmount (which may also have removed a
+	// raw block target file) must be a true no-op rather than erroring
+	// out of GetDeviceNameFromMount on a path that no longer exists.
+	if _, err := os.Stat(stagingTargetPath); err != nil {
+		if os.IsNotExist(err) {
+			glog.Infof("NodeUnstageVolume: %v does not exist, returning success", stagingTargetPath)
+			return &csi.NodeUnstageVolumeResponse{}, nil
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
 	_, refCount, err := mount.GetDeviceNameFromMount(node.mounter, stagingTargetPath)
 	fmt.Printf("refCount is %v", refCount)
 	if err != nil {
@@ -166,10 +296,40 @@ func (node *cbsNode) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstage
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
+	if err := removeIfBlockTargetFile(stagingTargetPath); err != nil {
+		glog.Errorf("NodeUnstageVolume: remove block target file %v error %v", stagingTargetPath, err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	if !crypto.IsInactive(node.mounter.Exec, req.VolumeId) {
+		if err := crypto.Close(node.mounter.Exec, req.VolumeId); err != nil {
+			glog.Errorf("NodeUnstageVolume: luksClose volume %v error %v", req.VolumeId, err)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	}
+
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
+// removeIfBlockTargetFile removes path if it is a regular file, leaving
+// mount-mode staging/publish directories in place.
+func removeIfBlockTargetFile(path string) error {
+	fi, err := os.Stat(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	if fi.IsDir() {
+		return nil
+	}
+	return os.Remove(path)
+}
+
 func (node *cbsNode) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
+	node.waitForHeal(ctx)
+
 	if req.VolumeId == "" {
 		return nil, status.Error(codes.InvalidArgument, "volume id is empty")
 	}
@@ -179,31 +339,40 @@ func (node *cbsNode) NodePublishVolume(ctx context.Context, req *csi.NodePublish
 	if req.TargetPath == "" {
 		return nil, status.Error(codes.InvalidArgument, "volume target path is empty")
 	}
-	if req.VolumeCapability == nil {
-		return nil, status.Error(codes.InvalidArgument, "volume has no capabilities")
+	isBlock, err := validateVolumeCapability(req.VolumeCapability)
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
 	}
 
-	if req.VolumeCapability.GetMount() == nil {
-		return nil, status.Error(codes.InvalidArgument, "volume access type is not mount")
+	if !node.volumeLocks.TryAcquire(req.VolumeId) {
+		return nil, status.Errorf(codes.Aborted, "operation already in progress for volume %s", req.VolumeId)
 	}
+	defer node.volumeLocks.Release(req.VolumeId)
 
 	source := req.StagingTargetPath
 	target := req.TargetPath
 
-	mountFlags := req.VolumeCapability.GetMount().MountFlags
-	mountFlags = append(mountFlags, "bind")
+	var mountFlags []string
+	var mountFsType string
+	if isBlock {
+		mountFlags = []string{"bind"}
+	} else {
+		mountFlags = append(req.VolumeCapability.GetMount().MountFlags, "bind")
+		mountFsType = req.VolumeCapability.GetMount().FsType
+		if mountFsType == "" {
+			mountFsType = "ext4"
+		}
+	}
 
 	if req.Readonly {
 		mountFlags = append(mountFlags, "ro")
 	}
 
-	mountFsType := req.VolumeCapability.GetMount().FsType
-
-	if mountFsType == "" {
-		mountFsType = "ext4"
-	}
-
-	if _, err := os.Stat(target); err != nil {
+	if isBlock {
+		if err := ensureBlockTargetFile(target); err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+	} else if _, err := os.Stat(target); err != nil {
 		if os.IsNotExist(err) {
 			err := os.MkdirAll(target, 0750)
 			if err != nil {
@@ -214,6 +383,25 @@ func (node *cbsNode) NodePublishVolume(ctx context.Context, req *csi.NodePublish
 		}
 	}
 
+	notMnt, err := mount.IsNotMountPoint(node.mounter, target)
+	if err != nil {
+		glog.Errorf("NodePublishVolume: IsNotMountPoint error %v", err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+	if !notMnt {
+		device, _, err := mount.GetDeviceNameFromMount(node.mounter, target)
+		if err != nil {
+			glog.Errorf("NodePublishVolume: GetDeviceNameFromMount error %v", err)
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		if device != source {
+			msg := fmt.Sprintf("targetPath %v already mounted from %v, expected %v", target, device, source)
+			return nil, status.Error(codes.FailedPrecondition, msg)
+		}
+		glog.Infof("NodePublishVolume: volume %v already published", req.VolumeId)
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
 	if err := node.mounter.Mount(source, target, mountFsType, mountFlags); err != nil {
 		glog.Errorf("NodePublishVolume: Mount error target %v error %v", target, err)
 		return nil, status.Error(codes.Internal, err.Error())
@@ -223,17 +411,37 @@ func (node *cbsNode) NodePublishVolume(ctx context.Context, req *csi.NodePublish
 }
 
 func (node *cbsNode) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
+	node.waitForHeal(ctx)
+
 	if req.TargetPath == "" {
 		return nil, status.Error(codes.InvalidArgument, "volume target path is empty")
 	}
 
+	if !node.volumeLocks.TryAcquire(req.VolumeId) {
+		return nil, status.Errorf(codes.Aborted, "operation already in progress for volume %s", req.VolumeId)
+	}
+	defer node.volumeLocks.Release(req.VolumeId)
+
 	targetPath := req.TargetPath
 
+	if _, err := os.Stat(targetPath); err != nil {
+		if os.IsNotExist(err) {
+			glog.Infof("NodeUnpublishVolume: %v does not exist, returning success", targetPath)
+			return &csi.NodeUnpublishVolumeResponse{}, nil
+		}
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
 	if err := node.mounter.Unmount(targetPath); err != nil {
 		glog.Errorf("NodeUnpublishVolume: Mount error targetPath %v error %v", targetPath, err)
 		return nil, status.Error(codes.Internal, err.Error())
 	}
 
+	if err := removeIfBlockTargetFile(targetPath); err != nil {
+		glog.Errorf("NodeUnpublishVolume: remove block target file %v error %v", targetPath, err)
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
 	return &csi.NodeUnpublishVolumeResponse{}, nil
 }
 
@@ -343,21 +551,49 @@ func (node *cbsNode) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVol
 func (node *cbsNode) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (*csi.NodeExpandVolumeResponse, error) {
 	glog.Infof("NodeExpandVolume: NodeExpandVolumeRequest is %v", *req)
 
+	node.waitForHeal(ctx)
+
 	volumeID := req.GetVolumeId()
 	if len(volumeID) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "Volume ID not provided")
 	}
 
+	if !node.volumeLocks.TryAcquire(volumeID) {
+		return nil, status.Errorf(codes.Aborted, "operation already in progress for volume %s", volumeID)
+	}
+	defer node.volumeLocks.Release(volumeID)
+
 	args := []string{"-o", "source", "--noheadings", "--target", req.GetVolumePath()}
 	output, err := node.mounter.Exec.Command("findmnt", args...).Output()
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "Could not determine device path: %v, raw block device or unmounted", err)
+		// No filesystem is mounted at this path, which is expected for a
+		// raw block volume: the disk itself already reflects the new CBS
+		// size once the hypervisor resizes it, there's no filesystem
+		// layer to grow.
+		cbsDisk := filepath.Join(DiskByIDDevicePath, DiskByIDDeviceNamePrefix+volumeID)
+		devicePath, resolveErr := findCBSVolume(cbsDisk)
+		if resolveErr != nil {
+			return nil, status.Errorf(codes.Internal, "Could not determine device path: %v, raw block device or unmounted", err)
+		}
+		if _, sizeErr := node.mounter.Exec.Command("blockdev", "--getsize64", devicePath).Output(); sizeErr != nil {
+			return nil, status.Errorf(codes.Internal, "Could not get size of raw block device %v: %v", devicePath, sizeErr)
+		}
+		glog.Infof("NodeExpandVolume: %v is a raw block volume, nothing to resize at the filesystem layer", devicePath)
+		return &csi.NodeExpandVolumeResponse{}, nil
 	}
 
 	devicePath := strings.TrimSpace(string(output))
 	if len(devicePath) == 0 {
 		return nil, status.Errorf(codes.Internal, "Could not get valid device for mount path: %v", req.GetVolumePath())
 	}
+	if devicePath == crypto.MapperPath(volumeID) {
+		// The mapper keeps reporting its old size until the LUKS layer
+		// itself is grown, so this has to happen before resizefs.
+		if err := crypto.Resize(node.mounter.Exec, volumeID); err != nil {
+			return nil, status.Errorf(codes.Internal, "Could not resize LUKS mapper for volume %s: %v", volumeID, err)
+		}
+	}
+
 	r := resizefs.NewResizeFs(&node.mounter)
 	if _, err := r.Resize(devicePath, req.GetVolumePath()); err != nil {
 		return nil, status.Errorf(codes.Internal, "Could not resize volume %s %s:  %v", volumeID, devicePath, err)
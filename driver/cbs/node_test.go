@@ -0,0 +1,57 @@
+package cbs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestEnsureBlockTargetFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "nested", "target")
+
+	if err := ensureBlockTargetFile(path); err != nil {
+		t.Fatalf("ensureBlockTargetFile() error = %v", err)
+	}
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat target: %v", err)
+	}
+	if fi.IsDir() {
+		t.Fatal("expected target to be a regular file, got a directory")
+	}
+
+	if err := ensureBlockTargetFile(path); err != nil {
+		t.Fatalf("ensureBlockTargetFile() on existing file error = %v", err)
+	}
+}
+
+func TestRemoveIfBlockTargetFile(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "target")
+	if err := ensureBlockTargetFile(file); err != nil {
+		t.Fatalf("setup: %v", err)
+	}
+
+	if err := removeIfBlockTargetFile(file); err != nil {
+		t.Fatalf("removeIfBlockTargetFile(file) error = %v", err)
+	}
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Fatalf("expected file to be removed, stat error = %v", err)
+	}
+
+	subdir := filepath.Join(dir, "subdir")
+	if err := os.MkdirAll(subdir, 0750); err != nil {
+		t.Fatalf("setup: %v", err)
+	}
+	if err := removeIfBlockTargetFile(subdir); err != nil {
+		t.Fatalf("removeIfBlockTargetFile(dir) error = %v", err)
+	}
+	if _, err := os.Stat(subdir); err != nil {
+		t.Fatalf("expected directory to be left in place, stat error = %v", err)
+	}
+
+	if err := removeIfBlockTargetFile(filepath.Join(dir, "missing")); err != nil {
+		t.Fatalf("removeIfBlockTargetFile(missing) error = %v", err)
+	}
+}
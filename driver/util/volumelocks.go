@@ -0,0 +1,24 @@
+package util
+
+import "sync"
+
+// VolumeLocks guards concurrent Node RPCs for the same volume.
+type VolumeLocks struct {
+	locks sync.Map // map[string]struct{}
+}
+
+// NewVolumeLocks returns an empty VolumeLocks.
+func NewVolumeLocks() *VolumeLocks {
+	return &VolumeLocks{}
+}
+
+// TryAcquire locks volumeID, returning false if already locked.
+func (l *VolumeLocks) TryAcquire(volumeID string) bool {
+	_, loaded := l.locks.LoadOrStore(volumeID, struct{}{})
+	return !loaded
+}
+
+// Release unlocks volumeID.
+func (l *VolumeLocks) Release(volumeID string) {
+	l.locks.Delete(volumeID)
+}
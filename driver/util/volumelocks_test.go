@@ -0,0 +1,28 @@
+package util
+
+import "testing"
+
+func TestVolumeLocksTryAcquire(t *testing.T) {
+	l := NewVolumeLocks()
+
+	if !l.TryAcquire("vol-1") {
+		t.Fatal("expected first TryAcquire to succeed")
+	}
+	if l.TryAcquire("vol-1") {
+		t.Fatal("expected second TryAcquire on a held volume to fail")
+	}
+	if !l.TryAcquire("vol-2") {
+		t.Fatal("expected TryAcquire on a different volume to succeed")
+	}
+}
+
+func TestVolumeLocksRelease(t *testing.T) {
+	l := NewVolumeLocks()
+
+	l.TryAcquire("vol-1")
+	l.Release("vol-1")
+
+	if !l.TryAcquire("vol-1") {
+		t.Fatal("expected TryAcquire to succeed after Release")
+	}
+}